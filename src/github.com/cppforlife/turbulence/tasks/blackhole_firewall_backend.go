@@ -0,0 +1,420 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+)
+
+// firewallRule is a backend-agnostic description of a single blackhole rule.
+// Each FirewallBackend is responsible for rendering it into its own syntax.
+type firewallRule struct {
+	Direction string // "INPUT" or "OUTPUT"
+	Hosts     []string
+	Family    string // "ipv4" or "ipv6"; selects iptables vs ip6tables and the nft address/ICMP family
+	Interface string // "-i"/"-o" value, depending on Direction
+
+	Protocol      string
+	DstPorts      string // single port/range, or a comma-separated list when DstPortsMulti
+	DstPortsMulti bool   // render as "-m multiport --dports" instead of "--dport"
+	SrcPorts      string
+	SrcPortsMulti bool // render as "-m multiport --sports" instead of "--sport"
+
+	Action     string // "DROP" (default), "REJECT", or "LIMIT"
+	RejectWith string // iptables --reject-with type, only meaningful when Action is "REJECT"
+	Limit      string // -m limit --limit rate, only meaningful when Action is "LIMIT"
+}
+
+// FirewallBackend installs and removes blackhole rules using a particular
+// firewall implementation (e.g. iptables or nftables).
+type FirewallBackend interface {
+	// Snapshot captures the current state managed by this backend so it can
+	// later be restored with Restore, undoing anything Apply installed.
+	Snapshot() (string, error)
+	Restore(string) error
+
+	// Apply installs all of the given rules atomically - one transaction for
+	// nftablesBackend, one per address family for iptablesBackend - so a
+	// malformed rule aborts its transaction instead of leaking partial state.
+	Apply([]firewallRule) error
+}
+
+const (
+	nftTableFamily = "inet"
+	nftTableName   = "turbulence"
+	nftInputChain  = "blackhole-in"
+	nftOutputChain = "blackhole-out"
+)
+
+// nftChainFor returns the base chain a rule belongs in: the "input" hook
+// never sees locally-originated (OUTPUT-direction) packets, so INPUT and
+// OUTPUT rules need their own hooked chain.
+func nftChainFor(direction string) string {
+	if direction == "OUTPUT" {
+		return nftOutputChain
+	}
+	return nftInputChain
+}
+
+// detectFirewallBackend picks a FirewallBackend based on opts.Backend. When
+// opts.Backend is "" or "auto" it probes for `nft` and falls back to
+// `iptables` when nft isn't usable on this host. It also returns the chosen
+// backend's name so callers can persist it alongside a firewall snapshot.
+func detectFirewallBackend(cmdRunner boshsys.CmdRunner, backend string) (FirewallBackend, string, error) {
+	switch backend {
+	case "", "auto":
+		_, _, _, err := cmdRunner.RunCommand("nft", "--version")
+		if err == nil {
+			return newNftablesBackend(cmdRunner), "nftables", nil
+		}
+		return newIptablesBackend(cmdRunner), "iptables", nil
+	case "nftables":
+		return newNftablesBackend(cmdRunner), "nftables", nil
+	case "iptables":
+		return newIptablesBackend(cmdRunner), "iptables", nil
+	default:
+		return nil, "", bosherr.Errorf("Invalid backend '%v', must be one of {auto, iptables, nftables} or blank.", backend)
+	}
+}
+
+// firewallBackendByName constructs a FirewallBackend directly from a name
+// previously recorded by detectFirewallBackend, bypassing auto-detection.
+// Used by RestoreFirewall to restore with the same backend that installed
+// the snapshot, even if capability probing would now pick differently.
+func firewallBackendByName(cmdRunner boshsys.CmdRunner, name string) (FirewallBackend, error) {
+	switch name {
+	case "nftables":
+		return newNftablesBackend(cmdRunner), nil
+	case "iptables":
+		return newIptablesBackend(cmdRunner), nil
+	default:
+		return nil, bosherr.Errorf("Unknown firewall backend '%v' recorded in snapshot", name)
+	}
+}
+
+type iptablesBackend struct {
+	cmdRunner boshsys.CmdRunner
+}
+
+func newIptablesBackend(cmdRunner boshsys.CmdRunner) iptablesBackend {
+	return iptablesBackend{cmdRunner}
+}
+
+// Apply installs all given rules as a single atomic transaction per address
+// family via `iptables-restore --noflush`/`ip6tables-restore --noflush`, so a
+// malformed rule aborts the whole batch instead of leaving a partial ruleset
+// installed one `iptables -A` at a time.
+func (b iptablesBackend) Apply(rules []firewallRule) error {
+	var v4Rules, v6Rules []firewallRule
+	for _, r := range rules {
+		if r.Family == "ipv6" {
+			v6Rules = append(v6Rules, r)
+		} else {
+			v4Rules = append(v4Rules, r)
+		}
+	}
+
+	if len(v4Rules) > 0 {
+		err := b.restore("iptables-restore", v4Rules)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(v6Rules) > 0 {
+		err := b.restore("ip6tables-restore", v6Rules)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b iptablesBackend) restore(cmdName string, rules []firewallRule) error {
+	script := "*filter\n"
+	for _, r := range rules {
+		script += "-A " + r.render() + "\n"
+	}
+	script += "COMMIT\n"
+
+	_, _, _, err := b.cmdRunner.RunCommandWithInput(script, cmdName, "--noflush")
+	if err != nil {
+		return bosherr.WrapError(err, "Shelling out to "+cmdName)
+	}
+
+	return nil
+}
+
+func (b iptablesBackend) Snapshot() (string, error) {
+	v4, _, _, err := b.cmdRunner.RunCommand("iptables-save")
+	if err != nil {
+		return "", bosherr.WrapError(err, "Shelling out to iptables-save")
+	}
+
+	v6, _, _, err := b.cmdRunner.RunCommand("ip6tables-save")
+	if err != nil {
+		return "", bosherr.WrapError(err, "Shelling out to ip6tables-save")
+	}
+
+	return v4 + ipv6SnapshotSeparator + v6, nil
+}
+
+func (b iptablesBackend) Restore(snapshot string) error {
+	parts := strings.SplitN(snapshot, ipv6SnapshotSeparator, 2)
+
+	_, _, _, err := b.cmdRunner.RunCommandWithInput(parts[0], "iptables-restore")
+	if err != nil {
+		return bosherr.WrapError(err, "Shelling out to iptables-restore")
+	}
+
+	if len(parts) == 2 {
+		_, _, _, err := b.cmdRunner.RunCommandWithInput(parts[1], "ip6tables-restore")
+		if err != nil {
+			return bosherr.WrapError(err, "Shelling out to ip6tables-restore")
+		}
+	}
+
+	return nil
+}
+
+// ipv6SnapshotSeparator joins the iptables-save and ip6tables-save outputs
+// into the single opaque snapshot string FirewallBackend.Snapshot returns.
+const ipv6SnapshotSeparator = "\n# turbulence-ip6tables-snapshot\n"
+
+// render produces the flag string consumed by the iptables CLI, using
+// --dport/--sport (or -m multiport --dports/--sports) for port matches.
+func (r firewallRule) render() string {
+	command := r.Direction
+
+	if r.Interface != "" {
+		if r.Direction == "INPUT" {
+			command += " -i " + r.Interface
+		} else {
+			command += " -o " + r.Interface
+		}
+	}
+
+	if r.Hosts != nil {
+		if r.Direction == "INPUT" {
+			command += " -s "
+		} else {
+			command += " -d "
+		}
+		command += strings.Join(r.Hosts, ",")
+	}
+
+	command += " -p " + r.Protocol
+
+	if r.DstPorts != "" {
+		if r.DstPortsMulti {
+			command += " -m multiport --dports " + r.DstPorts
+		} else {
+			command += " --dport " + r.DstPorts
+		}
+	}
+
+	if r.SrcPorts != "" {
+		if r.SrcPortsMulti {
+			command += " -m multiport --sports " + r.SrcPorts
+		} else {
+			command += " --sport " + r.SrcPorts
+		}
+	}
+
+	switch r.Action {
+	case "", "DROP":
+		command += " -j DROP"
+	case "REJECT":
+		command += " -j REJECT"
+		if r.RejectWith != "" {
+			command += " --reject-with " + r.RejectWith
+		}
+	case "LIMIT":
+		command += " -m limit --limit " + r.Limit + " -j DROP"
+	}
+
+	return command
+}
+
+// nftablesBackend manages a dedicated turbulence table with its own
+// input/output chains so installed rules never collide with the host's own
+// firewall rules.
+type nftablesBackend struct {
+	cmdRunner boshsys.CmdRunner
+}
+
+func newNftablesBackend(cmdRunner boshsys.CmdRunner) nftablesBackend {
+	return nftablesBackend{cmdRunner}
+}
+
+// ensureChains creates the dedicated turbulence table plus one base chain per
+// direction - the "input" hook only sees packets destined for the local
+// host, so OUTPUT-direction (locally-originated) rules need their own chain
+// hooked on "output" or they'd silently never match.
+func (b nftablesBackend) ensureChains() string {
+	return fmt.Sprintf(
+		"add table %s %s\n"+
+			"add chain %s %s %s { type filter hook input priority 0; }\n"+
+			"add chain %s %s %s { type filter hook output priority 0; }\n",
+		nftTableFamily, nftTableName,
+		nftTableFamily, nftTableName, nftInputChain,
+		nftTableFamily, nftTableName, nftOutputChain,
+	)
+}
+
+// Apply (re)creates the dedicated turbulence table/chains and installs all
+// given rules into the chain matching their Direction via a single
+// `nft -f -` invocation, so nft validates and commits the whole batch
+// atomically rather than rule by rule.
+func (b nftablesBackend) Apply(rules []firewallRule) error {
+	script := b.ensureChains() +
+		fmt.Sprintf("flush chain %s %s %s\n", nftTableFamily, nftTableName, nftInputChain) +
+		fmt.Sprintf("flush chain %s %s %s\n", nftTableFamily, nftTableName, nftOutputChain)
+
+	for _, r := range rules {
+		script += "add rule " + nftTableFamily + " " + nftTableName + " " + nftChainFor(r.Direction) + " " + r.nftMatch() + " " + r.nftVerdict() + "\n"
+	}
+
+	_, _, _, err := b.cmdRunner.RunCommandWithInput(script, "nft", "-f", "-")
+	if err != nil {
+		return bosherr.WrapError(err, "Shelling out to nft")
+	}
+
+	return nil
+}
+
+// Snapshot is a no-op for nftablesBackend: Apply only ever creates and
+// populates the dedicated turbulence table, so there's nothing elsewhere in
+// the host ruleset that needs capturing up front in order to undo it.
+func (b nftablesBackend) Snapshot() (string, error) {
+	return "", nil
+}
+
+// Restore deletes the dedicated turbulence table Apply created. Unlike
+// iptablesBackend, nft's block syntax is additive rather than a replace, so
+// there's no whole-ruleset snapshot to replay here - and none is needed,
+// since Apply never touches anything outside this table.
+func (b nftablesBackend) Restore(string) error {
+	script := fmt.Sprintf("delete table %s %s\n", nftTableFamily, nftTableName)
+
+	_, _, _, err := b.cmdRunner.RunCommandWithInput(script, "nft", "-f", "-")
+	if err != nil {
+		return bosherr.WrapError(err, "Shelling out to nft")
+	}
+
+	return nil
+}
+
+// nftMatch renders the match portion of an nft rule (everything between the
+// chain name and the final verdict).
+func (r firewallRule) nftMatch() string {
+	var parts []string
+
+	if r.Interface != "" {
+		field := "iifname"
+		if r.Direction == "OUTPUT" {
+			field = "oifname"
+		}
+		parts = append(parts, fmt.Sprintf("%s %q", field, r.Interface))
+	}
+
+	if r.Hosts != nil {
+		field := "daddr"
+		if r.Direction == "INPUT" {
+			field = "saddr"
+		}
+
+		addrFamily := "ip"
+		if r.Family == "ipv6" {
+			addrFamily = "ip6"
+		}
+
+		parts = append(parts, fmt.Sprintf("%s %s { %s }", addrFamily, field, strings.Join(r.Hosts, ", ")))
+	}
+
+	if r.Protocol != "all" && r.Protocol != "" {
+		parts = append(parts, r.Protocol)
+
+		if r.DstPorts != "" {
+			parts = append(parts, "dport "+nftPortSet(r.DstPorts, r.DstPortsMulti))
+		}
+
+		if r.SrcPorts != "" {
+			parts = append(parts, "sport "+nftPortSet(r.SrcPorts, r.SrcPortsMulti))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// nftPortSet renders a port/range as a bare value, or as an nft set literal
+// ("{ 80, 443 }") when it's a multi-entry list - nft has no separate
+// multiport matcher, sets work directly with dport/sport.
+func nftPortSet(ports string, multi bool) string {
+	if !multi {
+		return ports
+	}
+	return "{ " + strings.ReplaceAll(ports, ",", ", ") + " }"
+}
+
+// nftVerdict renders the final statement of an nft rule based on Action.
+func (r firewallRule) nftVerdict() string {
+	switch r.Action {
+	case "", "DROP":
+		return "drop"
+	case "REJECT":
+		if r.RejectWith == "tcp-reset" {
+			return "reject with tcp reset"
+		}
+		if r.RejectWith != "" {
+			return "reject with " + nftICMPProtocol(r.Family) + " type " + strings.TrimPrefix(r.RejectWith, "icmp-")
+		}
+		return "reject"
+	case "LIMIT":
+		return "limit rate " + nftLimitRate(r.Limit) + " drop"
+	default:
+		return "drop"
+	}
+}
+
+// nftICMPProtocol returns the nft reject protocol token matching family:
+// nft's "icmp" and "icmpv6" are protocol-specific, unlike iptables'
+// --reject-with which uses the same icmp-* names for both.
+func nftICMPProtocol(family string) string {
+	if family == "ipv6" {
+		return "icmpv6"
+	}
+	return "icmp"
+}
+
+// nftLimitRate translates a BlackholeTarget.Limit rate (validated by
+// BlackholeTask.action to be "<rate>/<sec|min|hour|day>") into nft's
+// `limit rate` syntax, which spells out the unit in full ("second" rather
+// than iptables' "sec").
+func nftLimitRate(limit string) string {
+	parts := limitPattern.FindStringSubmatch(limit)
+	if parts == nil {
+		return limit
+	}
+
+	rate := strings.TrimSuffix(limit, "/"+parts[1])
+
+	var unit string
+	switch parts[1] {
+	case "sec", "second":
+		unit = "second"
+	case "min", "minute":
+		unit = "minute"
+	case "hour":
+		unit = "hour"
+	case "day":
+		unit = "day"
+	default:
+		unit = parts[1]
+	}
+
+	return rate + "/" + unit
+}
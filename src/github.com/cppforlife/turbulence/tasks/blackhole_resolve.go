@@ -0,0 +1,142 @@
+package tasks
+
+import (
+	"sync"
+	"time"
+)
+
+// watchResolveIntervals starts a background refresh goroutine for every
+// target that sets ResolveInterval and resolves at least one hostname, so
+// short-TTL DNS records don't drift out from under an already-installed rule
+// over the lifetime of a long-running (or untimed) blackhole task. wg is
+// incremented once per goroutine started; the caller must wait on it after
+// closing stopCh, before undoing anything a late refresh might reapply.
+func (t BlackholeTask) watchResolveIntervals(stopCh chan struct{}, snapshot string, applyMu *sync.Mutex, wg *sync.WaitGroup) {
+	for _, target := range t.opts.Targets {
+		if target.ResolveInterval == "" || !t.isHostnameTarget(target) {
+			continue
+		}
+
+		interval, err := time.ParseDuration(target.ResolveInterval)
+		if err != nil {
+			t.logger.Error("BlackholeTask", "Invalid ResolveInterval '%v': %s", target.ResolveInterval, err.Error())
+			continue
+		}
+
+		wg.Add(1)
+		go func(target BlackholeTarget) {
+			defer wg.Done()
+			t.resolveLoop(target, interval, stopCh, snapshot, applyMu)
+		}(target)
+	}
+}
+
+// isHostnameTarget reports whether target resolves at least one of
+// Host/SrcHost/DstHost via DNS, as opposed to a literal IP/CIDR - only
+// hostname targets benefit from periodic re-resolution.
+func (t BlackholeTask) isHostnameTarget(target BlackholeTarget) bool {
+	return isHostname(target.Host) || isHostname(target.SrcHost) || isHostname(target.DstHost)
+}
+
+func isHostname(hostSpec string) bool {
+	return hostSpec != "" && !ip6Pattern.MatchString(hostSpec) && !ipPattern.MatchString(hostSpec)
+}
+
+// resolveLoop re-resolves target's hostname(s) on interval for the lifetime
+// of the task. When the resolved IP set changes - an address appeared or
+// disappeared - it recomputes the full ruleset across all targets and
+// swaps it in via reapply.
+func (t BlackholeTask) resolveLoop(target BlackholeTarget, interval time.Duration, stopCh chan struct{}, snapshot string, applyMu *sync.Mutex) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := t.resolvedIPSet(target)
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			select {
+			case <-stopCh:
+				// Execute is already tearing down; don't reapply rules it's
+				// about to restore over, or they'd never get removed.
+				return
+			default:
+			}
+
+			current := t.resolvedIPSet(target)
+			if ipSetsEqual(last, current) {
+				continue
+			}
+			last = current
+
+			err := t.reapply(snapshot, applyMu)
+			if err != nil {
+				t.logger.Error("BlackholeTask", "Refreshing blackhole rules: %s", err.Error())
+			}
+		}
+	}
+}
+
+// resolvedIPSet resolves every hostname field on target and returns the
+// union of their current IPs, ignoring resolution errors - a transient DNS
+// failure just means this tick retries against the last known-good set.
+func (t BlackholeTask) resolvedIPSet(target BlackholeTarget) map[string]struct{} {
+	ips := map[string]struct{}{}
+
+	for _, hostSpec := range []string{target.Host, target.SrcHost, target.DstHost} {
+		if !isHostname(hostSpec) {
+			continue
+		}
+
+		v4Hosts, v6Hosts, err := t.resolveHost(hostSpec, target.Family)
+		if err != nil {
+			continue
+		}
+
+		for _, ip := range append(v4Hosts, v6Hosts...) {
+			ips[ip] = struct{}{}
+		}
+	}
+
+	return ips
+}
+
+func ipSetsEqual(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for ip := range a {
+		if _, ok := b[ip]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reapply recomputes the full ruleset across all targets (not just the one
+// whose hostname changed) and swaps it in by restoring the pre-task
+// snapshot and then re-applying. The two steps are separate calls, so if
+// Apply fails the host is left at the pre-task snapshot; Apply itself is
+// atomic per transaction, so a failure never leaves a half-applied batch.
+// Serialized by applyMu so a refresh can't race the final teardown restore
+// in Execute.
+func (t BlackholeTask) reapply(snapshot string, applyMu *sync.Mutex) error {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	rules, err := t.rules()
+	if err != nil {
+		return err
+	}
+
+	err = t.backend.Restore(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return t.backend.Apply(rules)
+}
@@ -0,0 +1,82 @@
+package tasks
+
+import (
+	"path/filepath"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-utils/errors"
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+)
+
+// snapshotDir holds per-task firewall snapshots taken before a blackhole
+// task installs its rules, so a hard crash of the agent can still be
+// recovered from via RestoreFirewall.
+const snapshotDir = "/var/vcap/data/turbulence"
+
+// snapshotBackendSeparator splits the recorded backend name from the
+// snapshot body within a single snapshot file.
+const snapshotBackendSeparator = "\n"
+
+func snapshotPath(taskID string) string {
+	return filepath.Join(snapshotDir, taskID+".snapshot")
+}
+
+func saveSnapshot(fs boshsys.FileSystem, taskID, backendName, snapshot string) error {
+	contents := backendName + snapshotBackendSeparator + snapshot
+
+	err := fs.WriteFileString(snapshotPath(taskID), contents)
+	if err != nil {
+		return bosherr.WrapError(err, "Writing firewall snapshot")
+	}
+
+	return nil
+}
+
+func loadSnapshot(fs boshsys.FileSystem, taskID string) (string, string, error) {
+	contents, err := fs.ReadFileString(snapshotPath(taskID))
+	if err != nil {
+		return "", "", bosherr.WrapError(err, "Reading firewall snapshot")
+	}
+
+	parts := strings.SplitN(contents, snapshotBackendSeparator, 2)
+	if len(parts) != 2 {
+		return "", "", bosherr.Errorf("Malformed firewall snapshot for task %v", taskID)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// RestoreFirewall forcibly restores the firewall snapshot recorded for
+// taskID, undoing whatever rules a blackhole task installed. It's the
+// library entry point a `turbulence-agent restore-firewall` subcommand would
+// call to recover a host left in a blackholed state after the agent was
+// killed before it could tear its own rules down.
+//
+// NOTE: this package contains only the `tasks` library; the agent's CLI
+// entrypoint/subcommand dispatch (the `main` package that would parse
+// `restore-firewall <task-id>` off argv and call this function) lives
+// elsewhere in turbulence-release and isn't part of this source tree, so
+// there's no wiring to add here.
+func RestoreFirewall(cmdRunner boshsys.CmdRunner, fs boshsys.FileSystem, taskID string) error {
+	backendName, snapshot, err := loadSnapshot(fs, taskID)
+	if err != nil {
+		return err
+	}
+
+	backend, err := firewallBackendByName(cmdRunner, backendName)
+	if err != nil {
+		return err
+	}
+
+	err = backend.Restore(snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = fs.RemoveAll(snapshotPath(taskID))
+	if err != nil {
+		return bosherr.WrapError(err, "Removing firewall snapshot")
+	}
+
+	return nil
+}
@@ -3,8 +3,12 @@
 package tasks
 
 import (
+	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 
 	bosherr "github.com/cloudfoundry/bosh-utils/errors"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
@@ -15,20 +19,37 @@ type BlackholeOptions struct {
 	Type    string
 	Timeout string // Times may be suffixed with ms,s,m,h
 
+	// Optional firewall backend to use, must be in the set {auto, iptables, nftables}. Defaults to "auto",
+	// which probes for `nft` and falls back to `iptables` when nft isn't usable on the host.
+	Backend string
+
 	Targets []BlackholeTarget
 }
 
 var ipPattern = regexp.MustCompile(`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})(/\d{0,2})?`)
+var ip6Pattern = regexp.MustCompile(`([0-9a-fA-F]{0,4}:){2,7}[0-9a-fA-F]{0,4}(/\d{1,3})?`)
 var portPattern = regexp.MustCompile(`\d+(:\d+)?$`)
-
-// BlackholeTarget defines a rule for iptables. Each rule must contain one of {Host, DstPorts, SrcPorts}.
-// If DstPorts or SrcPorts ports are included without a Host, then those ports will be blocked for all hosts.
-// If Host is included without DstPorts or SrcPorts, then all traffic to/from those hosts will be blocked.
+var limitPattern = regexp.MustCompile(`^\d+/(sec|second|min|minute|hour|day)$`)
+
+// BlackholeTarget defines a rule for iptables. Each rule must contain one of
+// {Host, SrcHost, DstHost, DstPorts, SrcPorts, DstPortsList, SrcPortsList}.
+// If DstPorts/SrcPorts/DstPortsList/SrcPortsList ports are included without a host, then those ports will be
+// blocked for all hosts; under the iptables backend such a host-less rule is installed with iptables only, so it
+// matches IPv4 traffic only, and Family does not apply to it. If a host is included without any ports, then all traffic to/from that host will be
+// blocked.
 type BlackholeTarget struct {
 	// Optional host to block, can specify an address such as "10.34.4.60", an address block such as "192.168.0.0/24",
-	// or a domain name such as "google.com" which will be resolved to an Ip.
+	// or a domain name such as "google.com" which will be resolved to an Ip. Host is a shortcut for setting both
+	// SrcHost and DstHost to the same value; an explicit SrcHost or DstHost takes precedence over Host for that
+	// direction.
 	Host string
 
+	// Optional source host to block, matched against the INPUT direction with "-s". Same formats as Host.
+	SrcHost string
+
+	// Optional destination host to block, matched against the OUTPUT direction with "-d". Same formats as Host.
+	DstHost string
+
 	// Optional direction to block traffic, must be in the set {INPUT, OUTPUT, BOTH}. Defaults to "BOTH".
 	Direction string
 
@@ -36,26 +57,77 @@ type BlackholeTarget struct {
 	Protocol string
 
 	// Optional "dport" or destination port(s) to block. Specify a single port such as "8080" or a range such as "4530:6740".
+	// Only valid when Protocol is "tcp" or "udp". Mutually exclusive with DstPortsList.
 	DstPorts string
 
 	// Optional "sport" or source port(s) to block. Specify a single port such as "8080" or a range such as "4530:6740".
+	// Only valid when Protocol is "tcp" or "udp". Mutually exclusive with SrcPortsList.
 	SrcPorts string
+
+	// Optional list of destination ports to block, compiled to "-m multiport --dports" when it has more than one
+	// entry. Only valid when Protocol is "tcp" or "udp". Mutually exclusive with DstPorts.
+	DstPortsList []string
+
+	// Optional list of source ports to block, compiled to "-m multiport --sports" when it has more than one entry.
+	// Only valid when Protocol is "tcp" or "udp". Mutually exclusive with SrcPorts.
+	SrcPortsList []string
+
+	// Optional network interface to restrict matching to, mapped to "-i" for INPUT and "-o" for OUTPUT
+	// (e.g. "eth0" or an overlay interface such as "flannel.1").
+	Interface string
+
+	// Optional IP family to restrict host resolution/matching to, must be in the set {ipv4, ipv6, both}.
+	// Defaults to "both", blackholing all A and AAAA records for a hostname.
+	Family string
+
+	// Optional interval (e.g. "30s") at which a hostname Host/SrcHost/DstHost is re-resolved for the
+	// lifetime of the task, so short-TTL DNS records (ELBs, CDNs, Consul-backed records) don't drift out
+	// from under an installed rule. Has no effect on literal IP/CIDR hosts. Times may be suffixed with
+	// ms,s,m,h.
+	ResolveInterval string
+
+	// Optional action to take on matching packets, must be in the set {DROP, REJECT, LIMIT}. Defaults to "DROP".
+	Action string
+
+	// Optional iptables --reject-with type (e.g. "icmp-host-unreachable", "tcp-reset"), only valid when Action
+	// is "REJECT". "tcp-reset" is only valid when Protocol is "tcp".
+	RejectWith string
+
+	// Required when Action is "LIMIT": a rate formatted as "<rate>/<sec|min|hour|day>" (e.g. "10/sec"), so only
+	// a fraction of matching packets are dropped instead of all of them. Passed to iptables' -m limit --limit
+	// as-is; translated to nft's full-word rate unit ("second"/"minute"/"hour"/"day") under the nftables backend.
+	Limit string
 }
 
 func (BlackholeOptions) _private() {}
 
 type BlackholeTask struct {
-	cmdRunner boshsys.CmdRunner
-	opts      BlackholeOptions
-	logger	  boshlog.Logger
+	cmdRunner   boshsys.CmdRunner
+	fs          boshsys.FileSystem
+	taskID      string
+	opts        BlackholeOptions
+	logger      boshlog.Logger
+	backend     FirewallBackend
+	backendName string
 }
 
+// NewBlackholeTask constructs a BlackholeTask. taskID identifies this
+// particular task execution and namespaces the firewall snapshot taken in
+// Execute, so concurrent blackhole tasks don't clobber each other's
+// snapshot file under snapshotDir.
 func NewBlackholeTask(
 	cmdRunner boshsys.CmdRunner,
+	fs boshsys.FileSystem,
+	taskID string,
 	opts BlackholeOptions,
 	logger boshlog.Logger,
-) BlackholeTask {
-	return BlackholeTask{cmdRunner, opts, logger}
+) (BlackholeTask, error) {
+	backend, backendName, err := detectFirewallBackend(cmdRunner, opts.Backend)
+	if err != nil {
+		return BlackholeTask{}, err
+	}
+
+	return BlackholeTask{cmdRunner, fs, taskID, opts, logger, backend, backendName}, nil
 }
 
 func (t BlackholeTask) Execute(stopCh chan struct{}) error {
@@ -69,51 +141,76 @@ func (t BlackholeTask) Execute(stopCh chan struct{}) error {
 		return err
 	}
 
-	for _, r := range rules {
-		err := t.iptables("-A", r)
-		if err != nil {
-			return err
+	snapshot, err := t.backend.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	err = saveSnapshot(t.fs, t.taskID, t.backendName, snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = t.backend.Apply(rules)
+	if err != nil {
+		// iptablesBackend commits one transaction per address family, so a
+		// failure in a later family can follow an already-committed one;
+		// restore the snapshot so none of it stays installed.
+		restoreErr := t.backend.Restore(snapshot)
+		if restoreErr != nil {
+			t.logger.Error("BlackholeTask", "Rolling back failed apply: %s", restoreErr.Error())
 		}
+		return err
 	}
 
+	// SIGTERM/SIGINT of the agent process still reverts the firewall to the
+	// pre-task snapshot instead of leaving rules installed forever; a hard
+	// crash (SIGKILL, power loss) is instead recovered via RestoreFirewall
+	// reading the snapshot file back from disk.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+
+	// applyMu guards the installed ruleset against the final teardown restore
+	// below racing a concurrent refresh triggered by watchResolveIntervals.
+	// resolveWg is waited on before that restore so a refresh that's already
+	// in flight when stopResolving is closed always finishes - and loses the
+	// race to reapply its (possibly stale) rules - before teardown runs.
+	var applyMu sync.Mutex
+	var resolveWg sync.WaitGroup
+	stopResolving := make(chan struct{})
+	t.watchResolveIntervals(stopResolving, snapshot, &applyMu, &resolveWg)
+
 	select {
 	case <-timeoutCh:
 	case <-stopCh:
+	case <-sigCh:
 	}
 
-	for _, r := range rules {
-		err := t.iptables("-D", r)
-		if err != nil {
-			return err
-		}
+	close(stopResolving)
+	resolveWg.Wait()
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	err = t.backend.Restore(snapshot)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return t.fs.RemoveAll(snapshotPath(t.taskID))
 }
 
-func (t BlackholeTask) rules() ([]string, error) {
-	var rules []string
+func (t BlackholeTask) rules() ([]firewallRule, error) {
+	var rules []firewallRule
 	for _, target := range t.opts.Targets {
-		if target.Host == "" && target.DstPorts == "" && target.SrcPorts == "" {
-			return nil, bosherr.Error("Must specify at least one of Host, DstPorts, and or SrcPorts.")
-		}
-
-		var hosts []string
-		var direction, protocol, dports, sports string
-		
-		if target.Host == "" {
-			hosts = nil
-		} else if ipPattern.MatchString(target.Host) {
-			hosts = ipPattern.FindAllString(target.Host, -1)
-		} else {
-			var err error
-			hosts, err = t.dig(target.Host)
-			
-			if err != nil {
-				return nil, err
-			}
+		if target.Host == "" && target.SrcHost == "" && target.DstHost == "" && target.DstPorts == "" && target.SrcPorts == "" &&
+			len(target.DstPortsList) == 0 && len(target.SrcPortsList) == 0 {
+			return nil, bosherr.Error("Must specify at least one of Host, SrcHost, DstHost, DstPorts, SrcPorts, DstPortsList, and or SrcPortsList.")
 		}
 
+		var direction, protocol string
+
 		switch strings.ToUpper(target.Direction) {
 		case "":
 			direction = ""
@@ -142,99 +239,271 @@ func (t BlackholeTask) rules() ([]string, error) {
 			return nil, bosherr.Errorf("Invalid protocol '%v', must be one of {tcp, udp, icmp, all} or blank.", target.Protocol)
 		}
 
-		if target.DstPorts == "" {
-			dports = ""
-		} else if portPattern.MatchString(target.DstPorts) {
-			dports = target.DstPorts
-		} else {
-			return nil, bosherr.Errorf("Invalid destination port specified %v", target.DstPorts)
-		}
-
-		if target.SrcPorts == "" {
-			sports = ""
-		} else if portPattern.MatchString(target.SrcPorts) {
-			sports = target.SrcPorts
-		} else {
-			return nil, bosherr.Errorf("Invalid destination port specified %v", target.SrcPorts)
-		}
-		
-		
-		if direction == "" || direction == "INPUT" {
-			command := "INPUT"
-			
-			if hosts != nil {
-				command += " -s "
-				for i, ip := range hosts {
-					if i > 0 { command += ","}
-					command += ip
-				}
-			}
+		dports, dportsMulti, err := t.ports("destination", target.DstPorts, target.DstPortsList)
+		if err != nil {
+			return nil, err
+		}
 
-			command += " -p " + protocol
+		sports, sportsMulti, err := t.ports("source", target.SrcPorts, target.SrcPortsList)
+		if err != nil {
+			return nil, err
+		}
 
-			if dports != "" {
-				command += " -dport " + dports
-			}
-			
-			if sports != "" {
-				command += " -sport " + sports
+		if (dports != "" || sports != "") && (protocol == "icmp" || protocol == "all") {
+			return nil, bosherr.Errorf("DstPorts/SrcPorts require Protocol to be 'tcp' or 'udp', not '%v'.", protocol)
+		}
+
+		action, rejectWith, limit, err := t.action(target, protocol)
+		if err != nil {
+			return nil, err
+		}
+
+		srcHost := target.SrcHost
+		if srcHost == "" {
+			srcHost = target.Host
+		}
+
+		dstHost := target.DstHost
+		if dstHost == "" {
+			dstHost = target.Host
+		}
+
+		// A direction with no host of its own only gets a host-less rule when
+		// the target names no host at all, so e.g. a SrcHost-only target
+		// doesn't also block every OUTPUT packet.
+		anyHost := target.Host != "" || target.SrcHost != "" || target.DstHost != ""
+
+		if (direction == "" || direction == "INPUT") && (srcHost != "" || !anyHost) {
+			v4Hosts, v6Hosts, err := t.resolveHost(srcHost, target.Family)
+			if err != nil {
+				return nil, err
 			}
 
-			command += " -j DROP"
-			rules = append(rules, command)
+			for _, fam := range t.families(srcHost, v4Hosts, v6Hosts) {
+				rules = append(rules, firewallRule{
+					Direction:     "INPUT",
+					Hosts:         fam.hosts,
+					Family:        fam.name,
+					Interface:     target.Interface,
+					Protocol:      protocol,
+					DstPorts:      dports,
+					DstPortsMulti: dportsMulti,
+					SrcPorts:      sports,
+					SrcPortsMulti: sportsMulti,
+					Action:        action,
+					RejectWith:    rejectWith,
+					Limit:         limit,
+				})
+			}
 		}
 
-		if direction == "" || direction == "OUTPUT" {
-			command := "OUTPUT"
+		if (direction == "" || direction == "OUTPUT") && (dstHost != "" || !anyHost) {
+			v4Hosts, v6Hosts, err := t.resolveHost(dstHost, target.Family)
+			if err != nil {
+				return nil, err
+			}
 
-			if hosts != nil {
-				command += " -d "
-				for i, ip := range hosts {
-					if i > 0 { command += ","}
-					command += ip
-				}
+			for _, fam := range t.families(dstHost, v4Hosts, v6Hosts) {
+				rules = append(rules, firewallRule{
+					Direction:     "OUTPUT",
+					Hosts:         fam.hosts,
+					Family:        fam.name,
+					Interface:     target.Interface,
+					Protocol:      protocol,
+					DstPorts:      dports,
+					DstPortsMulti: dportsMulti,
+					SrcPorts:      sports,
+					SrcPortsMulti: sportsMulti,
+					Action:        action,
+					RejectWith:    rejectWith,
+					Limit:         limit,
+				})
 			}
+		}
+	}
+
+	return rules, nil
+}
 
-			command += " -p " + protocol
+// ports validates and normalizes a target's single port/range spec and its
+// list variant (mutually exclusive), returning the flag value and whether it
+// needs "-m multiport" (i.e. the list has more than one entry).
+func (t BlackholeTask) ports(label, single string, list []string) (string, bool, error) {
+	if len(list) > 0 {
+		if single != "" {
+			return "", false, bosherr.Errorf("Cannot specify both %v ports and %v ports list.", label, label)
+		}
 
-			if dports != "" {
-				command += " -dport " + dports
+		for _, port := range list {
+			if !portPattern.MatchString(port) {
+				return "", false, bosherr.Errorf("Invalid %v port specified %v", label, port)
 			}
-			
-			if sports != "" {
-				command += " -sport " + sports
+		}
+
+		return strings.Join(list, ","), len(list) > 1, nil
+	}
+
+	if single == "" {
+		return "", false, nil
+	}
+
+	if !portPattern.MatchString(single) {
+		return "", false, bosherr.Errorf("Invalid %v port specified %v", label, single)
+	}
+
+	return single, false, nil
+}
+
+// action validates target.Action/RejectWith/Limit and returns the normalized
+// firewallRule fields for them.
+func (t BlackholeTask) action(target BlackholeTarget, protocol string) (string, string, string, error) {
+	var action string
+
+	switch strings.ToUpper(target.Action) {
+	case "", "DROP":
+		action = "DROP"
+	case "REJECT":
+		action = "REJECT"
+	case "LIMIT":
+		action = "LIMIT"
+	default:
+		return "", "", "", bosherr.Errorf("Invalid action '%v', must be one of {DROP, REJECT, LIMIT} or blank.", target.Action)
+	}
+
+	if target.RejectWith != "" {
+		if action != "REJECT" {
+			return "", "", "", bosherr.Error("RejectWith may only be specified when Action is REJECT.")
+		}
+
+		switch target.RejectWith {
+		case "tcp-reset":
+			if protocol != "tcp" {
+				return "", "", "", bosherr.Errorf("RejectWith 'tcp-reset' is only valid when Protocol is 'tcp'.")
 			}
+		case "icmp-net-unreachable", "icmp-host-unreachable", "icmp-port-unreachable", "icmp-proto-unreachable",
+			"icmp-net-prohibited", "icmp-host-prohibited", "icmp-admin-prohibited":
+		default:
+			return "", "", "", bosherr.Errorf("Invalid RejectWith '%v'.", target.RejectWith)
+		}
+	}
 
-			command += " -j DROP"
-			rules = append(rules, command)
+	if action == "LIMIT" {
+		if target.Limit == "" {
+			return "", "", "", bosherr.Error("Limit must be specified when Action is LIMIT.")
+		}
+		if !limitPattern.MatchString(target.Limit) {
+			return "", "", "", bosherr.Errorf("Invalid Limit '%v', must be formatted as '<rate>/<sec|min|hour|day>'.", target.Limit)
 		}
 	}
 
-	return rules, nil
+	return action, target.RejectWith, target.Limit, nil
 }
 
-func (t BlackholeTask) dig(hostname string) ([]string, error) {
-	args := []string{"+short", hostname}
-	output, _, _, err := t.cmdRunner.RunCommand("dig", args...)
-	if err != nil {
-		return nil, bosherr.WrapError(err, "resolving host name")
+// resolveHost classifies and/or resolves hostSpec into its IPv4 and IPv6
+// addresses, restricted to wantFamily ({ipv4, ipv6, both}).
+func (t BlackholeTask) resolveHost(hostSpec, wantFamily string) ([]string, []string, error) {
+	var v4Hosts, v6Hosts []string
+
+	if hostSpec == "" {
+		return nil, nil, nil
+	} else if ip6Pattern.MatchString(hostSpec) {
+		v6Hosts = ip6Pattern.FindAllString(hostSpec, -1)
+	} else if ipPattern.MatchString(hostSpec) {
+		v4Hosts = ipPattern.FindAllString(hostSpec, -1)
+	} else {
+		var err error
+		v4Hosts, v6Hosts, err = t.dig(hostSpec)
+
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	ips := ipPattern.FindAllString(output, -1)
-	if ips == nil {
-		return nil, bosherr.Errorf("No IPs found for host %v", hostname)
+	switch strings.ToLower(wantFamily) {
+	case "", "both":
+	case "ipv4":
+		v6Hosts = nil
+	case "ipv6":
+		v4Hosts = nil
+	default:
+		return nil, nil, bosherr.Errorf("Invalid family '%v', must be one of {ipv4, ipv6, both} or blank.", wantFamily)
 	}
-	
-	return ips, nil
+
+	return v4Hosts, v6Hosts, nil
 }
 
-func (t BlackholeTask) iptables(action, rule string) error {
-	args := append([]string{action}, strings.Split(rule, " ")...)
+// families groups resolved hosts by IP family so that rules() can emit one
+// firewallRule per family. hostSpec is the (possibly empty) host this target
+// was asked to resolve: when it's "" no host was specified at all, and a
+// single family-less ("ipv4") rule is emitted for back-compat with pre-IPv6
+// behavior. When hostSpec is non-empty but v4Hosts/v6Hosts both came back
+// nil - a host was specified but target.Family filtered every address it
+// resolved to - no rule is emitted for this direction at all, instead of a
+// host-less rule that would match every address.
+type hostFamily struct {
+	name  string
+	hosts []string
+}
+
+func (t BlackholeTask) families(hostSpec string, v4Hosts, v6Hosts []string) []hostFamily {
+	if v4Hosts == nil && v6Hosts == nil {
+		if hostSpec == "" {
+			return []hostFamily{{name: "ipv4", hosts: nil}}
+		}
+		return nil
+	}
+
+	var families []hostFamily
+	if v4Hosts != nil {
+		families = append(families, hostFamily{name: "ipv4", hosts: v4Hosts})
+	}
+	if v6Hosts != nil {
+		families = append(families, hostFamily{name: "ipv6", hosts: v6Hosts})
+	}
+
+	return families
+}
+
+// dig resolves both A and AAAA records for hostname in parallel, so a
+// mixed-family hostname (e.g. google.com) blackholes both its IPv4 and IPv6
+// addresses.
+func (t BlackholeTask) dig(hostname string) ([]string, []string, error) {
+	var wg sync.WaitGroup
+	var v4Hosts, v6Hosts []string
+	var v4Err, v6Err error
+
+	wg.Add(2)
 
-	_, _, _, err := t.cmdRunner.RunCommand("iptables", args...)
+	go func() {
+		defer wg.Done()
+		v4Hosts, v4Err = t.digFamily(hostname, "A", ipPattern)
+	}()
+
+	go func() {
+		defer wg.Done()
+		v6Hosts, v6Err = t.digFamily(hostname, "AAAA", ip6Pattern)
+	}()
+
+	wg.Wait()
+
+	if v4Err != nil && v6Err != nil {
+		return nil, nil, bosherr.Errorf("No IPs found for host %v", hostname)
+	}
+
+	return v4Hosts, v6Hosts, nil
+}
+
+func (t BlackholeTask) digFamily(hostname, recordType string, pattern *regexp.Regexp) ([]string, error) {
+	args := []string{"+short", recordType, hostname}
+	output, _, _, err := t.cmdRunner.RunCommand("dig", args...)
 	if err != nil {
-		return bosherr.WrapError(err, "Shelling out to iptables")
+		return nil, bosherr.WrapError(err, "resolving host name")
 	}
 
-	return nil
-}
\ No newline at end of file
+	ips := pattern.FindAllString(output, -1)
+	if ips == nil {
+		return nil, bosherr.Errorf("No %v records found for host %v", recordType, hostname)
+	}
+
+	return ips, nil
+}
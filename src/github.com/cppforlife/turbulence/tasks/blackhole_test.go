@@ -0,0 +1,504 @@
+package tasks
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	boshsys "github.com/cloudfoundry/bosh-utils/system"
+)
+
+// fakeCmdRunner is a minimal recording boshsys.CmdRunner used to assert on
+// the exact commands (and, for RunCommandWithInput, stdin script) a
+// FirewallBackend shells out to. outputs lets a test canned the stdout
+// returned for a given command name (e.g. "iptables-save").
+type fakeCmdRunner struct {
+	calls   []fakeCmdCall
+	outputs map[string]string
+}
+
+type fakeCmdCall struct {
+	cmd   []string
+	input string
+}
+
+func (r *fakeCmdRunner) RunCommand(cmdName string, args ...string) (string, string, int, error) {
+	r.calls = append(r.calls, fakeCmdCall{cmd: append([]string{cmdName}, args...)})
+	return r.outputs[cmdName], "", 0, nil
+}
+
+func (r *fakeCmdRunner) RunCommandWithInput(input, cmdName string, args ...string) (string, string, int, error) {
+	r.calls = append(r.calls, fakeCmdCall{cmd: append([]string{cmdName}, args...), input: input})
+	return r.outputs[cmdName], "", 0, nil
+}
+
+func (r *fakeCmdRunner) RunCommandQuietly(cmdName string, args ...string) (string, string, int, error) {
+	return r.RunCommand(cmdName, args...)
+}
+
+func (r *fakeCmdRunner) RunComplexCommand(cmd boshsys.Command) (string, string, int, error) {
+	return r.RunCommand(cmd.Name, cmd.Args...)
+}
+
+func (r *fakeCmdRunner) RunComplexCommandAsync(cmd boshsys.Command) (boshsys.Process, error) {
+	return nil, nil
+}
+
+func (r *fakeCmdRunner) CommandExists(cmdName string) bool {
+	return true
+}
+
+func TestFirewallRuleRender(t *testing.T) {
+	tests := []struct {
+		name string
+		rule firewallRule
+		want string
+	}{
+		{
+			name: "plain drop",
+			rule: firewallRule{Direction: "INPUT", Protocol: "all"},
+			want: "INPUT -p all -j DROP",
+		},
+		{
+			name: "dport uses double dash, not single",
+			rule: firewallRule{Direction: "OUTPUT", Protocol: "tcp", DstPorts: "8080"},
+			want: "OUTPUT -p tcp --dport 8080 -j DROP",
+		},
+		{
+			name: "sport uses double dash, not single",
+			rule: firewallRule{Direction: "INPUT", Protocol: "udp", SrcPorts: "53"},
+			want: "INPUT -p udp --sport 53 -j DROP",
+		},
+		{
+			name: "multiport dports",
+			rule: firewallRule{Direction: "OUTPUT", Protocol: "tcp", DstPorts: "80,443,8080", DstPortsMulti: true},
+			want: "OUTPUT -p tcp -m multiport --dports 80,443,8080 -j DROP",
+		},
+		{
+			name: "interface on INPUT uses -i",
+			rule: firewallRule{Direction: "INPUT", Protocol: "all", Interface: "eth0"},
+			want: "INPUT -i eth0 -p all -j DROP",
+		},
+		{
+			name: "interface on OUTPUT uses -o",
+			rule: firewallRule{Direction: "OUTPUT", Protocol: "all", Interface: "flannel.1"},
+			want: "OUTPUT -o flannel.1 -p all -j DROP",
+		},
+		{
+			name: "hosts joined on INPUT use -s",
+			rule: firewallRule{Direction: "INPUT", Protocol: "all", Hosts: []string{"10.0.0.1", "10.0.0.2"}},
+			want: "INPUT -s 10.0.0.1,10.0.0.2 -p all -j DROP",
+		},
+		{
+			name: "hosts joined on OUTPUT use -d",
+			rule: firewallRule{Direction: "OUTPUT", Protocol: "all", Hosts: []string{"10.0.0.1"}},
+			want: "OUTPUT -d 10.0.0.1 -p all -j DROP",
+		},
+		{
+			name: "reject with type",
+			rule: firewallRule{Direction: "INPUT", Protocol: "tcp", Action: "REJECT", RejectWith: "tcp-reset"},
+			want: "INPUT -p tcp -j REJECT --reject-with tcp-reset",
+		},
+		{
+			name: "limit drop",
+			rule: firewallRule{Direction: "INPUT", Protocol: "all", Action: "LIMIT", Limit: "10/sec"},
+			want: "INPUT -p all -m limit --limit 10/sec -j DROP",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.render()
+			if got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlackholeTaskRulesPortsAndInterface(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  BlackholeTarget
+		wantErr bool
+		check   func(t *testing.T, rules []firewallRule)
+	}{
+		{
+			name: "single dport requires tcp or udp protocol",
+			target: BlackholeTarget{
+				Host:     "10.0.0.1",
+				Protocol: "all",
+				DstPorts: "8080",
+			},
+			wantErr: true,
+		},
+		{
+			name: "icmp protocol rejects dport",
+			target: BlackholeTarget{
+				Host:     "10.0.0.1",
+				Protocol: "icmp",
+				DstPorts: "8080",
+			},
+			wantErr: true,
+		},
+		{
+			name: "multiport dports list compiles to -m multiport",
+			target: BlackholeTarget{
+				Host:         "10.0.0.1",
+				Protocol:     "tcp",
+				DstPortsList: []string{"80", "443", "8080"},
+			},
+			check: func(t *testing.T, rules []firewallRule) {
+				for _, r := range rules {
+					if !r.DstPortsMulti {
+						t.Errorf("expected DstPortsMulti on rule %+v", r)
+					}
+					if r.DstPorts != "80,443,8080" {
+						t.Errorf("DstPorts = %q, want %q", r.DstPorts, "80,443,8080")
+					}
+				}
+			},
+		},
+		{
+			name: "single-entry ports list does not need multiport",
+			target: BlackholeTarget{
+				Host:         "10.0.0.1",
+				Protocol:     "tcp",
+				DstPortsList: []string{"80"},
+			},
+			check: func(t *testing.T, rules []firewallRule) {
+				for _, r := range rules {
+					if r.DstPortsMulti {
+						t.Errorf("did not expect DstPortsMulti on rule %+v", r)
+					}
+				}
+			},
+		},
+		{
+			name: "cannot specify both DstPorts and DstPortsList",
+			target: BlackholeTarget{
+				Host:         "10.0.0.1",
+				Protocol:     "tcp",
+				DstPorts:     "80",
+				DstPortsList: []string{"443"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "DstPortsList alone, with no host, is a valid target",
+			target: BlackholeTarget{
+				Protocol:     "tcp",
+				DstPortsList: []string{"80", "443"},
+			},
+			check: func(t *testing.T, rules []firewallRule) {
+				if len(rules) == 0 {
+					t.Fatalf("expected rules to be generated")
+				}
+			},
+		},
+		{
+			name: "interface threaded onto every generated rule",
+			target: BlackholeTarget{
+				Host:      "10.0.0.1",
+				Interface: "eth0",
+			},
+			check: func(t *testing.T, rules []firewallRule) {
+				for _, r := range rules {
+					if r.Interface != "eth0" {
+						t.Errorf("Interface = %q, want %q", r.Interface, "eth0")
+					}
+				}
+			},
+		},
+		{
+			name: "limit rejects a malformed rate",
+			target: BlackholeTarget{
+				Host:   "10.0.0.1",
+				Action: "LIMIT",
+				Limit:  "10pps",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := BlackholeTask{opts: BlackholeOptions{Targets: []BlackholeTarget{tt.target}}}
+
+			rules, err := task.rules()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got rules %+v", rules)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			tt.check(t, rules)
+		})
+	}
+}
+
+func TestBlackholeTaskRulesSrcDstHostSplit(t *testing.T) {
+	task := BlackholeTask{
+		opts: BlackholeOptions{
+			Targets: []BlackholeTarget{
+				{SrcHost: "10.0.0.1", DstHost: "10.0.0.2"},
+			},
+		},
+	}
+
+	rules, err := task.rules()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var gotInput, gotOutput []string
+	for _, r := range rules {
+		switch r.Direction {
+		case "INPUT":
+			gotInput = r.Hosts
+		case "OUTPUT":
+			gotOutput = r.Hosts
+		}
+	}
+
+	if !reflect.DeepEqual(gotInput, []string{"10.0.0.1"}) {
+		t.Errorf("INPUT hosts = %v, want [10.0.0.1]", gotInput)
+	}
+	if !reflect.DeepEqual(gotOutput, []string{"10.0.0.2"}) {
+		t.Errorf("OUTPUT hosts = %v, want [10.0.0.2]", gotOutput)
+	}
+}
+
+func TestBlackholeTaskRulesFamilyFilteredToNothingEmitsNoRule(t *testing.T) {
+	// Host is IPv6-only, but Family restricts to ipv4: resolveHost resolves
+	// it, then the family filter leaves nothing. That must skip the rule
+	// entirely, not fall back to an unrestricted (Hosts: nil) one.
+	task := BlackholeTask{
+		opts: BlackholeOptions{
+			Targets: []BlackholeTarget{
+				{Host: "2001:db8::1", Family: "ipv4"},
+			},
+		},
+	}
+
+	rules, err := task.rules()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, r := range rules {
+		if r.Hosts == nil {
+			t.Errorf("got an unrestricted (Hosts: nil) rule %+v, want no rule at all", r)
+		}
+	}
+	if len(rules) != 0 {
+		t.Errorf("rules = %+v, want none", rules)
+	}
+}
+
+func TestFirewallRuleNftVerdict(t *testing.T) {
+	tests := []struct {
+		name string
+		rule firewallRule
+		want string
+	}{
+		{
+			name: "plain drop",
+			rule: firewallRule{Action: "DROP"},
+			want: "drop",
+		},
+		{
+			name: "tcp reset reject",
+			rule: firewallRule{Action: "REJECT", RejectWith: "tcp-reset"},
+			want: "reject with tcp reset",
+		},
+		{
+			name: "icmp reject needs the 'type' keyword",
+			rule: firewallRule{Action: "REJECT", RejectWith: "icmp-host-unreachable", Family: "ipv4"},
+			want: "reject with icmp type host-unreachable",
+		},
+		{
+			name: "ipv6 reject uses icmpv6, not icmp",
+			rule: firewallRule{Action: "REJECT", RejectWith: "icmp-host-unreachable", Family: "ipv6"},
+			want: "reject with icmpv6 type host-unreachable",
+		},
+		{
+			name: "limit rate spells out the unit in full",
+			rule: firewallRule{Action: "LIMIT", Limit: "10/sec"},
+			want: "limit rate 10/second drop",
+		},
+		{
+			name: "limit rate already using the full word passes through",
+			rule: firewallRule{Action: "LIMIT", Limit: "5/minute"},
+			want: "limit rate 5/minute drop",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.nftVerdict()
+			if got != tt.want {
+				t.Errorf("nftVerdict() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIptablesBackendApply(t *testing.T) {
+	cmdRunner := &fakeCmdRunner{}
+	backend := newIptablesBackend(cmdRunner)
+
+	rules := []firewallRule{
+		{Direction: "INPUT", Protocol: "tcp", DstPorts: "8080", Hosts: []string{"10.0.0.1"}, Family: "ipv4"},
+		{Direction: "OUTPUT", Protocol: "all", Hosts: []string{"2001:db8::1"}, Family: "ipv6"},
+	}
+
+	err := backend.Apply(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cmdRunner.calls) != 2 {
+		t.Fatalf("expected 2 commands run, got %d: %+v", len(cmdRunner.calls), cmdRunner.calls)
+	}
+
+	v4Call := cmdRunner.calls[0]
+	if !reflect.DeepEqual(v4Call.cmd, []string{"iptables-restore", "--noflush"}) {
+		t.Errorf("v4 command = %v, want [iptables-restore --noflush]", v4Call.cmd)
+	}
+	wantV4Script := "*filter\n-A INPUT -s 10.0.0.1 -p tcp --dport 8080 -j DROP\nCOMMIT\n"
+	if v4Call.input != wantV4Script {
+		t.Errorf("v4 script = %q, want %q", v4Call.input, wantV4Script)
+	}
+
+	v6Call := cmdRunner.calls[1]
+	if !reflect.DeepEqual(v6Call.cmd, []string{"ip6tables-restore", "--noflush"}) {
+		t.Errorf("v6 command = %v, want [ip6tables-restore --noflush]", v6Call.cmd)
+	}
+	wantV6Script := "*filter\n-A OUTPUT -d 2001:db8::1 -p all -j DROP\nCOMMIT\n"
+	if v6Call.input != wantV6Script {
+		t.Errorf("v6 script = %q, want %q", v6Call.input, wantV6Script)
+	}
+}
+
+func TestIptablesBackendSnapshotAndRestore(t *testing.T) {
+	cmdRunner := &fakeCmdRunner{outputs: map[string]string{
+		"iptables-save":  "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n",
+		"ip6tables-save": "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n",
+	}}
+	backend := newIptablesBackend(cmdRunner)
+
+	snapshot, err := backend.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(cmdRunner.calls[0].cmd, []string{"iptables-save"}) {
+		t.Errorf("first snapshot command = %v, want [iptables-save]", cmdRunner.calls[0].cmd)
+	}
+	if !reflect.DeepEqual(cmdRunner.calls[1].cmd, []string{"ip6tables-save"}) {
+		t.Errorf("second snapshot command = %v, want [ip6tables-save]", cmdRunner.calls[1].cmd)
+	}
+
+	cmdRunner.calls = nil
+
+	err = backend.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cmdRunner.calls) != 2 {
+		t.Fatalf("expected 2 commands run, got %d: %+v", len(cmdRunner.calls), cmdRunner.calls)
+	}
+	if !reflect.DeepEqual(cmdRunner.calls[0].cmd, []string{"iptables-restore"}) {
+		t.Errorf("restore v4 command = %v, want [iptables-restore]", cmdRunner.calls[0].cmd)
+	}
+	if cmdRunner.calls[0].input != "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n" {
+		t.Errorf("restore v4 input = %q", cmdRunner.calls[0].input)
+	}
+	if !reflect.DeepEqual(cmdRunner.calls[1].cmd, []string{"ip6tables-restore"}) {
+		t.Errorf("restore v6 command = %v, want [ip6tables-restore]", cmdRunner.calls[1].cmd)
+	}
+	if cmdRunner.calls[1].input != "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n" {
+		t.Errorf("restore v6 input = %q", cmdRunner.calls[1].input)
+	}
+}
+
+func TestNftablesBackendApplyRoutesRulesToHookedChains(t *testing.T) {
+	cmdRunner := &fakeCmdRunner{}
+	backend := newNftablesBackend(cmdRunner)
+
+	rules := []firewallRule{
+		{Direction: "INPUT", Protocol: "all", Hosts: []string{"10.0.0.1"}, Family: "ipv4"},
+		{Direction: "OUTPUT", Protocol: "all", Hosts: []string{"10.0.0.2"}, Family: "ipv4"},
+	}
+
+	err := backend.Apply(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cmdRunner.calls) != 1 {
+		t.Fatalf("expected a single nft invocation, got %d: %+v", len(cmdRunner.calls), cmdRunner.calls)
+	}
+
+	call := cmdRunner.calls[0]
+	if !reflect.DeepEqual(call.cmd, []string{"nft", "-f", "-"}) {
+		t.Errorf("command = %v, want [nft -f -]", call.cmd)
+	}
+
+	// The INPUT hook never sees locally-originated traffic, so an
+	// OUTPUT-direction rule installed there would silently never match -
+	// each rule must land in the chain hooked on its own direction.
+	for _, want := range []string{
+		"add table inet turbulence",
+		"add chain inet turbulence blackhole-in { type filter hook input priority 0; }",
+		"add chain inet turbulence blackhole-out { type filter hook output priority 0; }",
+		"flush chain inet turbulence blackhole-in",
+		"flush chain inet turbulence blackhole-out",
+		"add rule inet turbulence blackhole-in ip saddr { 10.0.0.1 } drop",
+		"add rule inet turbulence blackhole-out ip daddr { 10.0.0.2 } drop",
+	} {
+		if !strings.Contains(call.input, want) {
+			t.Errorf("script missing %q, got:\n%s", want, call.input)
+		}
+	}
+}
+
+func TestNftablesBackendRestoreOnlyDeletesOwnTable(t *testing.T) {
+	cmdRunner := &fakeCmdRunner{}
+	backend := newNftablesBackend(cmdRunner)
+
+	snapshot, err := backend.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cmdRunner.calls) != 0 {
+		t.Fatalf("Snapshot should not shell out, got calls %+v", cmdRunner.calls)
+	}
+
+	err = backend.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Restore must only ever delete turbulence's own table - the snapshot
+	// was never a full-ruleset dump, so there is nothing else to replay.
+	if len(cmdRunner.calls) != 1 {
+		t.Fatalf("expected a single nft invocation, got %d: %+v", len(cmdRunner.calls), cmdRunner.calls)
+	}
+
+	call := cmdRunner.calls[0]
+	if !reflect.DeepEqual(call.cmd, []string{"nft", "-f", "-"}) {
+		t.Errorf("command = %v, want [nft -f -]", call.cmd)
+	}
+	wantScript := "delete table inet turbulence\n"
+	if call.input != wantScript {
+		t.Errorf("script = %q, want %q", call.input, wantScript)
+	}
+}